@@ -0,0 +1,129 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/emitter-io/emitter/config"
+	"github.com/emitter-io/emitter/logging"
+)
+
+// ClusterState is the subset of cluster membership that is persisted to disk so a
+// node can rejoin the cluster on restart, even when its configured seed is no
+// longer reachable.
+type ClusterState struct {
+	ClusterKey string    `json:"cluster_key"`
+	KnownNodes []string  `json:"known_nodes"`
+	LastSeen   time.Time `json:"last_seen"`
+}
+
+// clusterStatePath returns the path at which the cluster state is persisted,
+// defaulting to a file alongside the serf snapshot.
+func clusterStatePath(cfg *config.ClusterConfig) string {
+	if cfg.StatePath != "" {
+		return cfg.StatePath
+	}
+	return filepath.Join(filepath.Dir(cfg.SnapshotPath), "cluster-state.json")
+}
+
+// loadClusterState reads the persisted cluster state from disk, returning an empty
+// state (not an error) if no state file exists yet.
+func loadClusterState(path string) (*ClusterState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &ClusterState{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	state := new(ClusterState)
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// save persists the cluster state to disk as JSON.
+func (cs *ClusterState) save(path string) error {
+	cs.LastSeen = time.Now()
+	data, err := json.MarshalIndent(cs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// saveClusterState snapshots the current cluster key and member list to disk. It
+// is called on every membership event and once more on shutdown.
+func (s *Service) saveClusterState() {
+	if s.clusterState == nil {
+		return
+	}
+
+	nodes := []string{}
+	for _, m := range s.cluster.Members() {
+		if m.Name == s.Name() {
+			continue
+		}
+		// Persist the member's own gossip port, not just its address: a portless
+		// seed falls back to our own bind port on rejoin, which silently breaks
+		// rejoin-after-restart for clusters that don't share one uniform port.
+		nodes = append(nodes, net.JoinHostPort(m.Addr.String(), strconv.Itoa(int(m.Port))))
+	}
+
+	s.clusterState.KnownNodes = nodes
+	s.clusterState.ClusterKey = s.Config.Cluster.KeyString
+	if err := s.clusterState.save(s.statePath); err != nil {
+		logging.LogError("service", "saving cluster state", err)
+	}
+}
+
+// clusterKey returns the configured gossip encryption key, generating and
+// persisting a new random one only when this node is bootstrapping a brand new
+// cluster on its own (no seed configured and no previously known peers to rejoin).
+// A node joining an existing cluster has no way to share a freshly generated key
+// with the peers it's joining, so it must either be given one explicitly or fall
+// back to the previous, unencrypted behaviour (nil SecretKey).
+func (s *Service) clusterKey() ([]byte, error) {
+	if key := s.Config.Cluster.Key(); key != nil {
+		return key, nil
+	}
+
+	if s.clusterState.ClusterKey != "" {
+		s.Config.Cluster.KeyString = s.clusterState.ClusterKey
+		return s.Config.Cluster.Key(), nil
+	}
+
+	if len(s.Config.Cluster.Seed) > 0 || len(s.clusterState.KnownNodes) > 0 {
+		return nil, nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	s.Config.Cluster.KeyString = base64.StdEncoding.EncodeToString(key)
+	return key, nil
+}
@@ -0,0 +1,160 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/emitter-io/emitter/logging"
+	"github.com/emitter-io/emitter/security"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// configUpdateEvent is the serf user event name for a signed config update.
+const configUpdateEvent = "config-update"
+
+// configUpdateAckEvent is broadcast once a node has successfully applied a
+// config update, so operators can confirm cluster-wide application.
+const configUpdateAckEvent = "config-update-ack"
+
+// nonceWindow bounds how far in the past IssuedAt may be before a config update
+// is rejected as stale, to limit the nonce cache a replay check has to retain.
+const nonceWindow = 5 * time.Minute
+
+// ConfigUpdate is the signed payload used to rotate the license on the cluster
+// without a restart. Only NewLicense is applied today; extend this (and
+// onConfigUpdate) before advertising additional fields on the wire.
+type ConfigUpdate struct {
+	NewLicense string    `json:"new_license,omitempty"`
+	IssuedAt   time.Time `json:"issued_at"`
+	Nonce      string    `json:"nonce"`
+}
+
+// configTrustRoot verifies and applies signed ConfigUpdate payloads received
+// over the cluster. It owns the nonce cache used to reject replays.
+type configTrustRoot struct {
+	key    *ecdsa.PublicKey
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+// loadConfigTrustRoot reads the PEM-encoded ECDSA public key at path that
+// signed config updates are verified against.
+func loadConfigTrustRoot(path string) (*configTrustRoot, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("service: unable to decode config trust root PEM")
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("service: config trust root must be an ECDSA public key")
+	}
+
+	return &configTrustRoot{key: key, nonces: make(map[string]time.Time)}, nil
+}
+
+// verify checks the JWS signature on raw, unmarshals its payload and rejects
+// it if it falls outside the replay window or reuses a nonce we've already
+// seen.
+func (t *configTrustRoot) verify(raw []byte) (*ConfigUpdate, error) {
+	signature, err := jose.ParseSigned(string(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := signature.Verify(t.key)
+	if err != nil {
+		return nil, err
+	}
+
+	var update ConfigUpdate
+	if err := json.Unmarshal(payload, &update); err != nil {
+		return nil, err
+	}
+
+	if time.Since(update.IssuedAt) > nonceWindow || time.Since(update.IssuedAt) < -nonceWindow {
+		return nil, errors.New("service: config update issued_at outside the accepted window")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for nonce, seen := range t.nonces {
+		if time.Since(seen) > nonceWindow {
+			delete(t.nonces, nonce)
+		}
+	}
+	if _, replayed := t.nonces[update.Nonce]; replayed {
+		return nil, errors.New("service: config update nonce already used")
+	}
+	t.nonces[update.Nonce] = time.Now()
+
+	return &update, nil
+}
+
+// onConfigUpdate is invoked when a config-update cluster event is received. It
+// verifies the JWS payload, hot-swaps the license and cipher, and acks so
+// operators can confirm cluster-wide application.
+func (s *Service) onConfigUpdate(raw []byte) error {
+	if s.configTrust == nil {
+		return errors.New("service: received a config update but no trust root is configured")
+	}
+
+	update, err := s.configTrust.verify(raw)
+	if err != nil {
+		return err
+	}
+
+	if update.NewLicense != "" {
+		license, err := security.ParseLicense(update.NewLicense)
+		if err != nil {
+			return err
+		}
+
+		cipher, err := license.Cipher()
+		if err != nil {
+			return err
+		}
+
+		s.licenseMu.Lock()
+		s.license = license
+		s.cipher = cipher
+		s.licenseMu.Unlock()
+	}
+
+	logging.LogAction("service", "applied signed config update")
+	return s.Broadcast(configUpdateAckEvent, s.Name())
+}
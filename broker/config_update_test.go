@@ -0,0 +1,113 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+func newTestTrustRoot(t *testing.T) (*configTrustRoot, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating test key: %v", err)
+	}
+
+	return &configTrustRoot{key: &key.PublicKey, nonces: make(map[string]time.Time)}, key
+}
+
+func signTestUpdate(t *testing.T, key *ecdsa.PrivateKey, update ConfigUpdate) []byte {
+	t.Helper()
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+	if err != nil {
+		t.Fatalf("creating signer: %v", err)
+	}
+
+	payload, err := json.Marshal(update)
+	if err != nil {
+		t.Fatalf("marshaling update: %v", err)
+	}
+
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatalf("signing update: %v", err)
+	}
+
+	raw, err := signed.CompactSerialize()
+	if err != nil {
+		t.Fatalf("serializing update: %v", err)
+	}
+	return []byte(raw)
+}
+
+func TestConfigTrustRootVerifyAccepts(t *testing.T) {
+	trust, key := newTestTrustRoot(t)
+	raw := signTestUpdate(t, key, ConfigUpdate{NewLicense: "abc", IssuedAt: time.Now(), Nonce: "nonce-1"})
+
+	update, err := trust.verify(raw)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if update.NewLicense != "abc" {
+		t.Fatalf("update.NewLicense = %q, want %q", update.NewLicense, "abc")
+	}
+}
+
+func TestConfigTrustRootVerifyRejectsReplay(t *testing.T) {
+	trust, key := newTestTrustRoot(t)
+	raw := signTestUpdate(t, key, ConfigUpdate{NewLicense: "abc", IssuedAt: time.Now(), Nonce: "nonce-1"})
+
+	if _, err := trust.verify(raw); err != nil {
+		t.Fatalf("first verify: %v", err)
+	}
+	if _, err := trust.verify(raw); err == nil {
+		t.Fatalf("expected replayed nonce to be rejected")
+	}
+}
+
+func TestConfigTrustRootVerifyRejectsStaleIssuedAt(t *testing.T) {
+	trust, key := newTestTrustRoot(t)
+	raw := signTestUpdate(t, key, ConfigUpdate{
+		NewLicense: "abc",
+		IssuedAt:   time.Now().Add(-2 * nonceWindow),
+		Nonce:      "nonce-1",
+	})
+
+	if _, err := trust.verify(raw); err == nil {
+		t.Fatalf("expected update issued outside the nonce window to be rejected")
+	}
+}
+
+func TestConfigTrustRootVerifyRejectsWrongKey(t *testing.T) {
+	trust, _ := newTestTrustRoot(t)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating other key: %v", err)
+	}
+	raw := signTestUpdate(t, otherKey, ConfigUpdate{NewLicense: "abc", IssuedAt: time.Now(), Nonce: "nonce-1"})
+
+	if _, err := trust.verify(raw); err == nil {
+		t.Fatalf("expected update signed by an untrusted key to be rejected")
+	}
+}
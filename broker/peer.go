@@ -0,0 +1,342 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emitter-io/emitter/encoding"
+	"github.com/emitter-io/emitter/logging"
+	"github.com/hashicorp/serf/serf"
+)
+
+// Frame kinds exchanged over the peer route connections.
+const (
+	frameHandshake byte = iota // Announces the dialing node's name.
+	frameSub                   // A subscription delta (subscribe).
+	frameUnsub                 // A subscription delta (unsubscribe).
+	frameMessage               // A topic message destined for remote subscribers.
+	frameKeepalive             // A periodic keepalive carrying a per-peer digest.
+)
+
+const peerKeepaliveInterval = 10 * time.Second
+
+// peerFrame represents a single message exchanged on a peer route connection.
+type peerFrame struct {
+	Kind    byte
+	Payload []byte
+}
+
+// peerConn represents a single connection to a remote peer on the route port.
+// writeMu serializes frame writes, since a peer's keepalive loop and arbitrary
+// connection goroutines routing subscriptions or messages can all write to the
+// same connection concurrently, and writeFrame's header/payload writes must not
+// interleave between them.
+type peerConn struct {
+	name    string
+	conn    net.Conn
+	writeMu sync.Mutex
+	closing chan bool
+}
+
+// send writes a single frame to the peer, holding writeMu for the duration so
+// concurrent senders can't interleave their header/payload writes.
+func (pc *peerConn) send(kind byte, payload []byte) error {
+	pc.writeMu.Lock()
+	defer pc.writeMu.Unlock()
+	return writeFrame(pc.conn, kind, payload)
+}
+
+// dialPeer establishes an outbound connection to a peer's advertised route address
+// and starts the read and keepalive loops for it.
+func (s *Service) dialPeer(name, addr string) error {
+	if _, ok := s.peers.Get(name); ok {
+		return nil // Already connected.
+	}
+
+	var conn net.Conn
+	var err error
+	if s.routeTLS != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, s.routeTLS)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, 5*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := writeFrame(conn, frameHandshake, []byte(s.Name())); err != nil {
+		conn.Close()
+		return err
+	}
+
+	s.addPeer(name, conn)
+	return nil
+}
+
+// writeMessageFrame encodes and sends a topic message to a single peer.
+func writeMessageFrame(pc *peerConn, topic string, payload []byte) error {
+	raw, err := encoding.Encode(&peerMessage{Topic: []byte(topic), Payload: payload})
+	if err != nil {
+		return err
+	}
+	return pc.send(frameMessage, raw)
+}
+
+// onAcceptPeer is called when a new peer connection is accepted on the route port.
+// The first frame on the connection must be a handshake identifying the dialer. When
+// route TLS is configured, the connection is still plaintext at this point, so it is
+// wrapped in a server-side TLS handshake before anything is read from it.
+func (s *Service) onAcceptPeer(t net.Conn) {
+	if s.routeTLS != nil {
+		t = tls.Server(t, s.routeTLS)
+	}
+
+	frame, err := readFrame(t)
+	if err != nil || frame.Kind != frameHandshake {
+		t.Close()
+		return
+	}
+
+	s.addPeer(string(frame.Payload), t)
+}
+
+// addPeer registers a peer connection and starts its read and keepalive loops.
+func (s *Service) addPeer(name string, conn net.Conn) {
+	pc := &peerConn{name: name, conn: conn, closing: make(chan bool)}
+	s.peers.Set(name, pc)
+	logging.LogAction("peer", "connected to "+name)
+
+	go s.peerReadLoop(pc)
+	go s.peerKeepaliveLoop(pc)
+}
+
+// removePeer closes and forgets a peer connection.
+func (s *Service) removePeer(name string) {
+	if v, ok := s.peers.Get(name); ok {
+		pc := v.(*peerConn)
+		close(pc.closing)
+		pc.conn.Close()
+		s.peers.Remove(name)
+		logging.LogAction("peer", "disconnected from "+name)
+	}
+}
+
+// peerReadLoop reads and dispatches frames from a single peer connection until it
+// fails, at which point the peer is forgotten (it will be re-dialed on the next
+// member-join event, if the member is still around).
+func (s *Service) peerReadLoop(pc *peerConn) {
+	for {
+		frame, err := readFrame(pc.conn)
+		if err != nil {
+			s.removePeer(pc.name)
+			return
+		}
+
+		switch frame.Kind {
+		case frameSub:
+			s.applySubscriptionEvent("+", frame.Payload)
+		case frameUnsub:
+			s.applySubscriptionEvent("-", frame.Payload)
+		case frameMessage:
+			s.onPeerMessage(frame.Payload)
+		case frameKeepalive:
+			// frame.Payload is pc.name's digest of the subscriber entries it holds
+			// on our behalf (DigestFor(us)). We compare it against our own view of
+			// what we expect pc.name to be holding (localDigestFor(pc.name)) -- the
+			// two are scoped to the same (us, pc.name) relationship and so actually
+			// converge once every node has finished rebalancing, unlike comparing
+			// either side's full, disjoint owned partition. A mismatch means we
+			// haven't (yet), so we re-send our local subscriptions to help it along.
+			if !bytes.Equal(frame.Payload, s.localDigestFor(pc.name)) {
+				logging.LogAction("peer", "digest mismatch with "+pc.name+", resyncing subscriptions")
+				s.rebalanceSubscriptions()
+			}
+		}
+	}
+}
+
+// peerKeepaliveLoop periodically sends pc.name the digest of the subscriber
+// entries we hold on its behalf, so both sides can detect a connection that
+// silently stopped delivering data as well as run the anti-entropy check above.
+func (s *Service) peerKeepaliveLoop(pc *peerConn) {
+	ticker := time.NewTicker(peerKeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pc.closing:
+			return
+		case <-s.Closing:
+			return
+		case <-ticker.C:
+			if err := pc.send(frameKeepalive, s.subscriptions.DigestFor(pc.name)); err != nil {
+				s.removePeer(pc.name)
+				return
+			}
+		}
+	}
+}
+
+// errPeerNotConnected is returned when a subscription delta needs to be routed
+// to a topic owner that we don't currently have a peer connection to; the next
+// member-join/leave rebalance or anti-entropy keepalive will retry it.
+var errPeerNotConnected = errors.New("service: no peer connection to topic owner")
+
+// encodeSubscriptionEvent encodes a SubscriptionEvent for transport over the
+// peer mesh.
+func encodeSubscriptionEvent(event *SubscriptionEvent) ([]byte, error) {
+	return encoding.Encode(event)
+}
+
+// onPeerMessage is invoked when a topic message forwarded by a peer is received on
+// the route connection. It delivers to our own local subscribers exactly as if the
+// message had arrived from a local client, and, if we are the topic's owner,
+// fans it out to every other node with a subscriber.
+func (s *Service) onPeerMessage(payload []byte) {
+	var msg peerMessage
+	if err := encoding.Decode(payload, &msg); err != nil {
+		logging.LogError("peer", "decoding forwarded message", err)
+		return
+	}
+
+	s.subscriptions.Publish(msg.Topic, msg.Payload)
+
+	topic := string(msg.Topic)
+	if s.ownerOf(topic) == s.Name() {
+		if err := s.fanOutMessage(topic, msg.Payload); err != nil {
+			logging.LogError("peer", "fanning out message for "+topic, err)
+		}
+	}
+}
+
+// peerMessage is the envelope used to forward a topic message to a remote node for
+// delivery to that node's local subscribers.
+type peerMessage struct {
+	Topic   []byte
+	Payload []byte
+}
+
+// applySubscriptionEvent decodes a subscription delta and applies it to the local
+// subscription trie. It is called for subscription frames read from the peer mesh.
+func (s *Service) applySubscriptionEvent(kind string, payload []byte) error {
+	var event SubscriptionEvent
+	if err := encoding.Decode(payload, &event); err != nil {
+		return err
+	}
+
+	if event.Node == s.Name() {
+		return nil
+	}
+
+	frameKind := frameSub
+	if kind == "-" {
+		frameKind = frameUnsub
+	}
+	return s.applyLocalSubscriptionEvent(frameKind, &event)
+}
+
+// applyLocalSubscriptionEvent applies a subscription delta to this node's own
+// subscription trie. It is the terminal step of delta delivery: reached either
+// because this node is the topic's owner (routeSubscription), or because the
+// delta arrived over the peer mesh (applySubscriptionEvent).
+func (s *Service) applyLocalSubscriptionEvent(kind byte, event *SubscriptionEvent) error {
+	switch kind {
+	case frameSub:
+		s.subscriptions.Subscribe(event.Node, event.Topic, event.Ssid)
+		s.dispatchEvent(Event{Type: "subscribe", Node: event.Node, Time: time.Now()})
+	case frameUnsub:
+		s.subscriptions.Unsubscribe(event.Node, event.Topic, event.Ssid)
+		s.dispatchEvent(Event{Type: "unsubscribe", Node: event.Node, Time: time.Now()})
+	default:
+		return errors.New("service: received unknown subscription event kind")
+	}
+
+	return nil
+}
+
+// onMemberJoin dials the route address advertised by every newly joined member.
+func (s *Service) onMemberJoin(members []serf.Member) {
+	for _, m := range members {
+		if m.Name == s.Name() {
+			continue
+		}
+
+		addr, ok := m.Tags["route"]
+		if !ok {
+			continue
+		}
+
+		if err := s.dialPeer(m.Name, addr); err != nil {
+			logging.LogError("peer", "dialing "+m.Name, err)
+		}
+	}
+}
+
+// onMemberLeave forgets peer connections for members that left or failed, and
+// garbage-collects any subscriber entries we own on their behalf.
+func (s *Service) onMemberLeave(members []serf.Member) {
+	for _, m := range members {
+		s.removePeer(m.Name)
+		s.subscriptions.RemoveNode(m.Name)
+	}
+}
+
+// writeFrame writes a single length-prefixed frame to the connection.
+func writeFrame(w io.Writer, kind byte, payload []byte) error {
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	header[4] = kind
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// maxFrameSize bounds the length prefix accepted on a peer route connection, so a
+// malformed or hostile frame can't force a multi-gigabyte allocation per connection.
+const maxFrameSize = 16 << 20 // 16 MiB
+
+// errFrameTooLarge is returned when a peer frame's length prefix exceeds maxFrameSize.
+var errFrameTooLarge = errors.New("service: peer frame exceeds the maximum allowed size")
+
+// readFrame reads a single length-prefixed frame from the connection.
+func readFrame(r io.Reader) (*peerFrame, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:4])
+	if size > maxFrameSize {
+		return nil, errFrameTooLarge
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	return &peerFrame{Kind: header[4], Payload: payload}, nil
+}
@@ -0,0 +1,64 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestWriteReadFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, frameSub, []byte("payload")); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+
+	frame, err := readFrame(&buf)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if frame.Kind != frameSub {
+		t.Fatalf("frame.Kind = %d, want %d", frame.Kind, frameSub)
+	}
+	if string(frame.Payload) != "payload" {
+		t.Fatalf("frame.Payload = %q, want %q", frame.Payload, "payload")
+	}
+}
+
+func TestReadFrameRejectsOversizedLength(t *testing.T) {
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header, maxFrameSize+1)
+	header[4] = frameSub
+
+	_, err := readFrame(bytes.NewReader(header))
+	if err != errFrameTooLarge {
+		t.Fatalf("readFrame with oversized length = %v, want %v", err, errFrameTooLarge)
+	}
+}
+
+func TestReadFrameAcceptsMaxSize(t *testing.T) {
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header, maxFrameSize)
+	header[4] = frameKeepalive
+
+	frame, err := readFrame(bytes.NewReader(append(header, make([]byte, maxFrameSize)...)))
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if frame.Kind != frameKeepalive || len(frame.Payload) != maxFrameSize {
+		t.Fatalf("unexpected frame: %+v", frame)
+	}
+}
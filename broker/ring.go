@@ -0,0 +1,173 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+
+	"github.com/emitter-io/emitter/logging"
+	"github.com/hashicorp/serf/serf"
+)
+
+// owner computes the rendezvous (HRW) hash owner of key among members. Both HRW
+// and jump-consistent hashing only need the sorted member list to be
+// reconstructed deterministically on every node, so ring rebuilds require no
+// coordination beyond the membership view serf already maintains.
+func owner(key string, members []string) string {
+	var best string
+	var bestWeight uint64
+	for _, m := range members {
+		w := hrwWeight(key, m)
+		if best == "" || w > bestWeight {
+			best = m
+			bestWeight = w
+		}
+	}
+	return best
+}
+
+// hrwWeight computes the HRW weight of a (key, member) pair.
+func hrwWeight(key, member string) uint64 {
+	h := sha256.Sum256([]byte(key + "\x00" + member))
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+// ringMembers returns the sorted set of currently alive member names forming
+// the hash ring.
+func (s *Service) ringMembers() []string {
+	members := s.cluster.Members()
+	names := make([]string, 0, len(members))
+	for _, m := range members {
+		if m.Status == serf.StatusAlive {
+			names = append(names, m.Name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// ownerOf returns the node currently responsible for the authoritative
+// subscriber set of a topic, given the current ring.
+func (s *Service) ownerOf(topic string) string {
+	return owner(topic, s.ringMembers())
+}
+
+// routeSubscription ships a subscription delta for topic to whichever node owns
+// it, or applies it to the local trie directly if we are the owner ourselves.
+// This replaces broadcasting every delta to every peer: subscription traffic is
+// now O(subscriptions) unicasts instead of O(subscriptions x members).
+func (s *Service) routeSubscription(kind byte, topic string, event *SubscriptionEvent) error {
+	owner := s.ownerOf(topic)
+	if owner == "" || owner == s.Name() {
+		return s.applyLocalSubscriptionEvent(kind, event)
+	}
+
+	v, ok := s.peers.Get(owner)
+	if !ok {
+		return errPeerNotConnected
+	}
+
+	payload, err := encodeSubscriptionEvent(event)
+	if err != nil {
+		return err
+	}
+	return v.(*peerConn).send(kind, payload)
+}
+
+// Subscribe records a subscription made by a locally-connected client and routes
+// it to the topic's owner node over the peer mesh, applying it directly if we are
+// the owner ourselves. Connection handling calls this instead of broadcasting the
+// delta to every node, which is what bounds subscription traffic to one unicast
+// per subscription rather than one broadcast per subscription per node.
+func (s *Service) Subscribe(topic string, ssid Ssid) error {
+	s.subscriptions.SubscribeLocal(topic, ssid)
+	return s.routeSubscription(frameSub, topic, &SubscriptionEvent{Node: s.Name(), Topic: topic, Ssid: ssid})
+}
+
+// Unsubscribe is the Subscribe counterpart, called when a locally-connected
+// client unsubscribes.
+func (s *Service) Unsubscribe(topic string, ssid Ssid) error {
+	s.subscriptions.UnsubscribeLocal(topic, ssid)
+	return s.routeSubscription(frameUnsub, topic, &SubscriptionEvent{Node: s.Name(), Topic: topic, Ssid: ssid})
+}
+
+// rebalanceSubscriptions is called whenever the ring changes (a member joined
+// or left). Every node walks its own locally-originated subscriptions and
+// re-sends them to the new owner if ownership moved; the previous owner GCs the
+// stale entry once it notices the node departed via onMemberLeave.
+func (s *Service) rebalanceSubscriptions() {
+	for _, sub := range s.subscriptions.Local() {
+		event := &SubscriptionEvent{Node: s.Name(), Topic: sub.Topic, Ssid: sub.Ssid}
+		if err := s.routeSubscription(frameSub, sub.Topic, event); err != nil {
+			logging.LogError("ring", "rebalancing subscription for "+sub.Topic, err)
+		}
+	}
+}
+
+// localDigestFor returns a hash, in the same form as SubscriptionTrie.DigestFor,
+// of our local subscriptions that currently route to owner ownerName. This is the
+// comparable counterpart to the digest an owner sends back in a keepalive: "what
+// do I expect this owner to be holding on my behalf", rather than that owner's
+// entire (and, by design, disjoint) owned partition.
+func (s *Service) localDigestFor(ownerName string) []byte {
+	var topics []string
+	for _, sub := range s.subscriptions.Local() {
+		if s.ownerOf(sub.Topic) == ownerName {
+			topics = append(topics, sub.Topic)
+		}
+	}
+	return topicDigest(topics)
+}
+
+// Publish delivers payload to this node's own local subscribers of topic, then
+// routes it to the topic's owner so it can be fanned out to every other node with
+// a subscriber, mirroring how Subscribe/Unsubscribe route deltas to the owner.
+func (s *Service) Publish(topic string, payload []byte) error {
+	s.subscriptions.Publish([]byte(topic), payload)
+
+	owner := s.ownerOf(topic)
+	if owner == "" || owner == s.Name() {
+		return s.fanOutMessage(topic, payload)
+	}
+
+	v, ok := s.peers.Get(owner)
+	if !ok {
+		return errPeerNotConnected
+	}
+	return writeMessageFrame(v.(*peerConn), topic, payload)
+}
+
+// fanOutMessage is called by a topic's owner to forward a published message to
+// every node with a local subscriber, once directly (from Publish) or once per
+// remote publish received over the peer mesh (from onPeerMessage).
+func (s *Service) fanOutMessage(topic string, payload []byte) error {
+	for _, node := range s.subscriptions.OwnedSubscribers(topic) {
+		if node == s.Name() {
+			continue
+		}
+
+		v, ok := s.peers.Get(node)
+		if !ok {
+			continue
+		}
+		if err := writeMessageFrame(v.(*peerConn), topic, payload); err != nil {
+			logging.LogError("ring", "forwarding message to "+node, err)
+		}
+	}
+	return nil
+}
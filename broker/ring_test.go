@@ -0,0 +1,67 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import "testing"
+
+func TestHrwWeightDeterministic(t *testing.T) {
+	w1 := hrwWeight("a/topic", "node-1")
+	w2 := hrwWeight("a/topic", "node-1")
+	if w1 != w2 {
+		t.Fatalf("hrwWeight is not deterministic: got %d and %d", w1, w2)
+	}
+}
+
+func TestHrwWeightVariesByMember(t *testing.T) {
+	w1 := hrwWeight("a/topic", "node-1")
+	w2 := hrwWeight("a/topic", "node-2")
+	if w1 == w2 {
+		t.Fatalf("expected different weights for different members, got %d for both", w1)
+	}
+}
+
+func TestOwnerPicksHighestWeight(t *testing.T) {
+	members := []string{"node-1", "node-2", "node-3"}
+	key := "some/topic"
+
+	var want string
+	var bestWeight uint64
+	for _, m := range members {
+		w := hrwWeight(key, m)
+		if want == "" || w > bestWeight {
+			want = m
+			bestWeight = w
+		}
+	}
+
+	if got := owner(key, members); got != want {
+		t.Fatalf("owner(%q, %v) = %q, want %q", key, members, got, want)
+	}
+}
+
+func TestOwnerStableAcrossMemberOrder(t *testing.T) {
+	key := "some/topic"
+	a := owner(key, []string{"node-1", "node-2", "node-3"})
+	b := owner(key, []string{"node-3", "node-1", "node-2"})
+	if a != b {
+		t.Fatalf("owner should not depend on member slice order: got %q and %q", a, b)
+	}
+}
+
+func TestOwnerEmptyMembers(t *testing.T) {
+	if got := owner("some/topic", nil); got != "" {
+		t.Fatalf("owner with no members = %q, want empty string", got)
+	}
+}
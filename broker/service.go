@@ -15,6 +15,7 @@
 package broker
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -22,6 +23,7 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -43,10 +45,10 @@ import (
 type Service struct {
 	Closing          chan bool                 // The channel for closing signal.
 	Counters         *perf.Counters            // The performance counters for this service.
-	Cipher           *security.Cipher          // The cipher to use for decoding and encoding keys.
-	License          *security.License         // The licence for this emitter server.
 	Config           *config.Config            // The configuration for the service.
 	ContractProvider security.ContractProvider // The contract provider for the service.
+	cipher           *security.Cipher          // The cipher to use for decoding and encoding keys, accessed via Cipher().
+	license          *security.License         // The licence for this emitter server, accessed via License().
 	subscriptions    *SubscriptionTrie         // The subscription matching trie.
 	http             *http.Server              // The underlying HTTP server.
 	tcp              *tcp.Server               // The underlying TCP server.
@@ -54,6 +56,13 @@ type Service struct {
 	peers            *collection.ConcurrentMap // The map of all the connected peers for this server.
 	events           chan serf.Event           // The channel for receiving gossip events.
 	name             string                    // The name of the service.
+	routeTLS         *tls.Config               // The TLS configuration used to serve and dial the peer route port, if any.
+	clusterState     *ClusterState             // The persisted cluster state, used to rejoin after a restart.
+	statePath        string                    // The path at which the cluster state is persisted.
+	sinks            []Sink                    // The chain of sinks that subscription and lifecycle events are dispatched to.
+	sinksMu          sync.Mutex                // Guards sinks, which can be appended to and read from concurrently.
+	licenseMu        sync.RWMutex              // Guards cipher and license, which can be hot-swapped by a signed config update.
+	configTrust      *configTrustRoot          // Verifies signed config updates received over the cluster, if configured.
 }
 
 // NewService creates a new service.
@@ -66,6 +75,7 @@ func NewService(cfg *config.Config) (s *Service, err error) {
 		events:        make(chan serf.Event),
 		http:          new(http.Server),
 		tcp:           new(tcp.Server),
+		peers:         collection.NewConcurrentMap(),
 	}
 
 	// Attach handlers
@@ -75,12 +85,26 @@ func NewService(cfg *config.Config) (s *Service, err error) {
 	// Parse the license
 	logging.LogAction("service", "external address is "+address.External().String())
 	logging.LogAction("service", "reading the license...")
-	if s.License, err = security.ParseLicense(cfg.License); err != nil {
+	if s.license, err = security.ParseLicense(cfg.License); err != nil {
 		return nil, err
 	}
 
 	// Create a new cipher from the licence provided
-	if s.Cipher, err = s.License.Cipher(); err != nil {
+	if s.cipher, err = s.license.Cipher(); err != nil {
+		return nil, err
+	}
+
+	// Load the persisted cluster state, if clustering is enabled, so we can rejoin
+	// the cluster on restart even if our configured seed is no longer reachable.
+	if cfg.Cluster != nil {
+		s.statePath = clusterStatePath(cfg.Cluster)
+		if s.clusterState, err = loadClusterState(s.statePath); err != nil {
+			return nil, err
+		}
+	}
+
+	// Load the trust root used to verify signed config updates, if configured.
+	if s.configTrust, err = loadConfigTrustRoot(cfg.ConfigTrustRoot); err != nil {
 		return nil, err
 	}
 
@@ -98,7 +122,12 @@ func (s *Service) clusterConfig(cfg *config.Config) *serf.Config {
 	c.MemberlistConfig = memberlist.DefaultWANConfig()
 	c.MemberlistConfig.BindPort = cfg.Cluster.Gossip
 	c.MemberlistConfig.AdvertisePort = cfg.Cluster.Gossip
-	c.MemberlistConfig.SecretKey = cfg.Cluster.Key()
+
+	// Reuse a previously generated cluster key rather than requiring the operator
+	// to re-supply one on every restart.
+	if key, err := s.clusterKey(); err == nil {
+		c.MemberlistConfig.SecretKey = key
+	}
 
 	// Set the node name
 	c.NodeName = cfg.Cluster.NodeName
@@ -122,6 +151,22 @@ func (s *Service) Name() string {
 	return s.name
 }
 
+// License returns the license currently in effect, guarded by licenseMu since a
+// signed config update can hot-swap it at any time.
+func (s *Service) License() *security.License {
+	s.licenseMu.RLock()
+	defer s.licenseMu.RUnlock()
+	return s.license
+}
+
+// Cipher returns the cipher currently in effect, guarded by licenseMu since a
+// signed config update can hot-swap it alongside the license.
+func (s *Service) Cipher() *security.Cipher {
+	s.licenseMu.RLock()
+	defer s.licenseMu.RUnlock()
+	return s.cipher
+}
+
 // Listens to incoming cluster events.
 func (s *Service) clusterEventLoop() {
 	for {
@@ -129,11 +174,22 @@ func (s *Service) clusterEventLoop() {
 		case <-s.Closing:
 			return
 		case e := <-s.events:
-			if e.EventType() == serf.EventUser {
+			switch e.EventType() {
+			case serf.EventUser:
 				event := e.(serf.UserEvent)
 				if err := s.onEvent(&event); err != nil {
 					logging.LogError("service", "event received", err)
 				}
+
+			case serf.EventMemberJoin:
+				s.onMemberJoin(e.(serf.MemberEvent).Members)
+				s.rebalanceSubscriptions()
+				s.saveClusterState()
+
+			case serf.EventMemberLeave, serf.EventMemberFailed:
+				s.onMemberLeave(e.(serf.MemberEvent).Members)
+				s.rebalanceSubscriptions()
+				s.saveClusterState()
 			}
 		}
 	}
@@ -146,19 +202,37 @@ func (s *Service) Listen() (err error) {
 
 	// Create the cluster if required
 	if s.Config.Cluster != nil {
+		// Build the TLS configuration for the peer route port, if configured, before
+		// touching the cluster config: this is where we fail fast if route TLS is
+		// requested without gossip encryption, and clusterConfig (via clusterKey) may
+		// auto-generate and fill in a gossip key where the operator left one unset.
+		routeTLS, err := newRouteTLSConfig(s.Config.Cluster)
+		if err != nil {
+			return err
+		}
+		s.routeTLS = routeTLS
+
 		if s.cluster, err = serf.Create(s.clusterConfig(s.Config)); err != nil {
 			return err
 		}
 
-		// Listen on cluster event loop
+		// Listen on cluster event loop. onAcceptPeer itself wraps the accepted
+		// connection in a TLS server handshake when route TLS is configured, so the
+		// listener here stays plain.
 		go s.clusterEventLoop()
 		if err := tcp.ServeAsync(s.Config.Cluster.Route, s.Closing, s.onAcceptPeer); err != nil {
 			panic(err)
 		}
 	}
 
-	// Join our seed
-	s.Join(s.Config.Cluster.Seed)
+	// Join our seed, falling back to the addresses we last saw the cluster at if no
+	// seed was configured, so a rolled node can rejoin without a reachable seed.
+	seed := s.Config.Cluster.Seed
+	if len(seed) == 0 && s.clusterState != nil && len(s.clusterState.KnownNodes) > 0 {
+		logging.LogAction("service", "no seed configured, rejoining from persisted cluster state")
+		seed = s.clusterState.KnownNodes
+	}
+	s.Join(seed...)
 
 	go func() {
 		for {
@@ -211,13 +285,12 @@ func (s *Service) Broadcast(name string, message interface{}) error {
 
 // Occurs when a new client connection is accepted.
 func (s *Service) onAcceptConn(t net.Conn) {
+	s.dispatchEvent(Event{Type: "connect", Node: s.Name(), Time: time.Now()})
 	conn := s.newConn(t)
-	go conn.Process()
-}
-
-// Occurs when a new peer connection is accepted.
-func (s *Service) onAcceptPeer(t net.Conn) {
-
+	go func() {
+		conn.Process()
+		s.dispatchEvent(Event{Type: "disconnect", Node: s.Name(), Time: time.Now()})
+	}()
 }
 
 // Occurs when a new HTTP request is received.
@@ -231,23 +304,14 @@ func (s *Service) onRequest(w http.ResponseWriter, r *http.Request) {
 // Occurs when a new cluster event is received.
 func (s *Service) onEvent(e *serf.UserEvent) error {
 	switch e.Name {
-	case "+":
-		// This is a subscription event which occurs when a client is subscribed to a node.
-		var event SubscriptionEvent
-		encoding.Decode(e.Payload, &event)
+	case configUpdateEvent:
+		// A signed, JOSE-encoded config update, used to rotate the license without a
+		// restart. No other runtime configuration is applied from it.
+		return s.onConfigUpdate(e.Payload)
 
-		if event.Node != s.Name() {
-			fmt.Printf("%+v\n", event)
-		}
-
-	case "-":
-		// This is an unsubscription event which occurs when a client is unsubscribed from a node.
-		var event SubscriptionEvent
-		encoding.Decode(e.Payload, &event)
-
-		if event.Node != s.Name() {
-			fmt.Printf("%+v\n", event)
-		}
+	case configUpdateAckEvent:
+		// A peer confirming it applied a config update we (or another operator) issued.
+		logging.LogAction("service", fmt.Sprintf("node %s applied the config update", string(e.Payload)))
 
 	default:
 		return errors.New("received unknown event name: " + e.Name)
@@ -285,10 +349,20 @@ func (s *Service) Close() {
 
 	// Gracefully leave the cluster and shutdown the listener.
 	if s.cluster != nil {
+		s.saveClusterState()
 		_ = s.cluster.Leave()
 		_ = s.cluster.Shutdown()
 	}
 
+	// Tear down every peer route connection.
+	for v := range s.peers.IterBuffered() {
+		s.removePeer(v.Key)
+	}
+
+	// Close every registered sink. A QueueSink discards any events it has not yet
+	// forwarded.
+	s.closeSinks()
+
 	// Notify we're closed
 	close(s.Closing)
 }
@@ -0,0 +1,290 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/emitter-io/emitter/logging"
+)
+
+// Event represents a subscription or lifecycle event emitted by the service,
+// destined for any sink registered via Service.AddSink.
+type Event struct {
+	Type string    `json:"type"` // One of "subscribe", "unsubscribe", "connect" or "disconnect".
+	Node string    `json:"node"` // The node on which the event occurred.
+	Time time.Time `json:"time"` // The time at which the event occurred.
+}
+
+// Sink represents a destination for events emitted by the service.
+type Sink interface {
+	Write(Event) error
+	Close() error
+}
+
+// AddSink registers a sink to receive every subscription and lifecycle event
+// dispatched by the service, in addition to the sinks already registered.
+func (s *Service) AddSink(sink Sink) {
+	s.sinksMu.Lock()
+	defer s.sinksMu.Unlock()
+	s.sinks = append(s.sinks, sink)
+}
+
+// dispatchEvent fans an event out to every registered sink, logging (but not
+// failing on) any individual sink error.
+func (s *Service) dispatchEvent(evt Event) {
+	s.sinksMu.Lock()
+	sinks := s.sinks
+	s.sinksMu.Unlock()
+
+	for _, sink := range sinks {
+		if err := sink.Write(evt); err != nil {
+			logging.LogError("sink", "writing event", err)
+		}
+	}
+}
+
+// closeSinks closes every registered sink, used during a graceful shutdown.
+func (s *Service) closeSinks() {
+	s.sinksMu.Lock()
+	defer s.sinksMu.Unlock()
+
+	for _, sink := range s.sinks {
+		if err := sink.Close(); err != nil {
+			logging.LogError("sink", "closing sink", err)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+// FileSink writes events as newline-delimited JSON to a file on disk.
+type FileSink struct {
+	file *os.File
+	enc  *json.Encoder
+}
+
+// NewFileSink opens (or creates) a file at path and returns a Sink that appends
+// one JSON object per event to it.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Write appends evt to the file as a single JSON line.
+func (s *FileSink) Write(evt Event) error {
+	return s.enc.Encode(evt)
+}
+
+// Close closes the underlying file.
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+// ----------------------------------------------------------------------------
+
+// WebhookSink POSTs each event as JSON to a configured URL.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSink creates a sink that POSTs every event to url.
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Write POSTs evt to the configured URL as a JSON body.
+func (s *WebhookSink) Write(evt Event) error {
+	body, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Close is a no-op for WebhookSink, which holds no persistent resources.
+func (s *WebhookSink) Close() error {
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+
+// ChannelSink delivers events to an in-memory channel, primarily useful in tests.
+type ChannelSink struct {
+	Events chan Event
+}
+
+// NewChannelSink creates a ChannelSink buffering up to size events.
+func NewChannelSink(size int) *ChannelSink {
+	return &ChannelSink{Events: make(chan Event, size)}
+}
+
+// Write sends evt on the channel, blocking if it is full.
+func (s *ChannelSink) Write(evt Event) error {
+	s.Events <- evt
+	return nil
+}
+
+// Close closes the channel.
+func (s *ChannelSink) Close() error {
+	close(s.Events)
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+
+// RetrySink wraps a Sink and retries a failed write with exponential backoff
+// before giving up and returning the last error.
+type RetrySink struct {
+	Sink    Sink
+	Retries int
+	Backoff time.Duration
+}
+
+// NewRetrySink wraps sink with up to retries retries after the first attempt,
+// doubling backoff after every failed attempt starting at backoff.
+func NewRetrySink(sink Sink, retries int, backoff time.Duration) *RetrySink {
+	return &RetrySink{Sink: sink, Retries: retries, Backoff: backoff}
+}
+
+// Write attempts to write evt to the wrapped sink, retrying on failure.
+func (s *RetrySink) Write(evt Event) error {
+	wait := s.Backoff
+	var err error
+	for attempt := 0; attempt <= s.Retries; attempt++ {
+		if err = s.Sink.Write(evt); err == nil {
+			return nil
+		}
+
+		if attempt < s.Retries {
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+	return err
+}
+
+// Close closes the wrapped sink.
+func (s *RetrySink) Close() error {
+	return s.Sink.Close()
+}
+
+// ----------------------------------------------------------------------------
+
+// FilterSink wraps a Sink and only forwards events whose Type is in Allow.
+type FilterSink struct {
+	Sink  Sink
+	Allow map[string]bool
+}
+
+// NewFilterSink wraps sink so that only events of the given types reach it.
+func NewFilterSink(sink Sink, types ...string) *FilterSink {
+	allow := make(map[string]bool, len(types))
+	for _, t := range types {
+		allow[t] = true
+	}
+	return &FilterSink{Sink: sink, Allow: allow}
+}
+
+// Write forwards evt to the wrapped sink only if its type is allowed.
+func (s *FilterSink) Write(evt Event) error {
+	if !s.Allow[evt.Type] {
+		return nil
+	}
+	return s.Sink.Write(evt)
+}
+
+// Close closes the wrapped sink.
+func (s *FilterSink) Close() error {
+	return s.Sink.Close()
+}
+
+// ----------------------------------------------------------------------------
+
+// QueueSink wraps a Sink with a bounded buffer, dropping the oldest queued event
+// (and incrementing a counter) rather than blocking the caller when full.
+type QueueSink struct {
+	sink     Sink
+	queue    chan Event
+	counters *Service
+	closing  chan bool
+}
+
+// NewQueueSink creates a QueueSink that buffers up to size events for sink,
+// draining them on a background goroutine. Dropped events increment
+// "sink.dropped" on the owning service's counters.
+func (s *Service) NewQueueSink(sink Sink, size int) *QueueSink {
+	q := &QueueSink{
+		sink:     sink,
+		queue:    make(chan Event, size),
+		counters: s,
+		closing:  make(chan bool),
+	}
+
+	go q.loop()
+	return q
+}
+
+// loop drains the queue and forwards events to the wrapped sink.
+func (s *QueueSink) loop() {
+	for {
+		select {
+		case <-s.closing:
+			return
+		case evt := <-s.queue:
+			if err := s.sink.Write(evt); err != nil {
+				logging.LogError("sink", "queue sink writing event", err)
+			}
+		}
+	}
+}
+
+// Write enqueues evt, dropping the oldest queued event if the buffer is full.
+func (s *QueueSink) Write(evt Event) error {
+	select {
+	case s.queue <- evt:
+	default:
+		select {
+		case <-s.queue:
+			s.counters.Counters.Increment("sink.dropped")
+		default:
+		}
+		s.queue <- evt
+	}
+	return nil
+}
+
+// Close stops the drain loop and closes the wrapped sink.
+func (s *QueueSink) Close() error {
+	close(s.closing)
+	return s.sink.Close()
+}
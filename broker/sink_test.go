@@ -0,0 +1,104 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/perf"
+)
+
+// newTestQueueSink builds a QueueSink without running its drain loop, so the
+// queue's contents can be inspected directly instead of racing a goroutine.
+func newTestQueueSink(sink Sink, size int) *QueueSink {
+	return &QueueSink{
+		sink:     sink,
+		queue:    make(chan Event, size),
+		counters: &Service{Counters: perf.NewCounters()},
+		closing:  make(chan bool),
+	}
+}
+
+// recordingSink counts writes and optionally fails the next N of them, used to
+// exercise the retry/filter/queue wrappers without a real backing sink.
+type recordingSink struct {
+	writes []Event
+	fail   int
+	closed bool
+}
+
+func (s *recordingSink) Write(evt Event) error {
+	if s.fail > 0 {
+		s.fail--
+		return errors.New("recordingSink: simulated failure")
+	}
+	s.writes = append(s.writes, evt)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestRetrySinkSucceedsAfterRetries(t *testing.T) {
+	inner := &recordingSink{fail: 2}
+	sink := NewRetrySink(inner, 3, time.Millisecond)
+
+	if err := sink.Write(Event{Type: "subscribe"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if len(inner.writes) != 1 {
+		t.Fatalf("expected the write to eventually succeed, got %d recorded writes", len(inner.writes))
+	}
+}
+
+func TestRetrySinkGivesUpAfterRetries(t *testing.T) {
+	inner := &recordingSink{fail: 10}
+	sink := NewRetrySink(inner, 2, time.Millisecond)
+
+	if err := sink.Write(Event{Type: "subscribe"}); err == nil {
+		t.Fatalf("expected Write to fail after exhausting retries")
+	}
+}
+
+func TestFilterSinkOnlyForwardsAllowedTypes(t *testing.T) {
+	inner := &recordingSink{}
+	sink := NewFilterSink(inner, "subscribe")
+
+	sink.Write(Event{Type: "subscribe"})
+	sink.Write(Event{Type: "unsubscribe"})
+
+	if len(inner.writes) != 1 || inner.writes[0].Type != "subscribe" {
+		t.Fatalf("expected only the subscribe event to be forwarded, got %+v", inner.writes)
+	}
+}
+
+func TestQueueSinkDropsOldestWhenFull(t *testing.T) {
+	inner := &recordingSink{}
+	sink := newTestQueueSink(inner, 1)
+
+	sink.Write(Event{Type: "connect"})
+	sink.Write(Event{Type: "disconnect"})
+
+	if len(sink.queue) != 1 {
+		t.Fatalf("expected the bounded queue to hold exactly 1 event, got %d", len(sink.queue))
+	}
+	if queued := <-sink.queue; queued.Type != "disconnect" {
+		t.Fatalf("expected the oldest event to have been dropped, queue held %+v", queued)
+	}
+}
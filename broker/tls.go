@@ -0,0 +1,81 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+
+	"github.com/emitter-io/emitter/config"
+)
+
+// errHalfEncrypted is returned when a route TLS bundle is configured without gossip
+// encryption, which would leave the cluster partially protected.
+var errHalfEncrypted = errors.New("service: route TLS is configured but Cluster.Key is not set, refusing to start a half-encrypted cluster")
+
+// newRouteTLSConfig builds the *tls.Config used both to serve and to dial the peer
+// route port, from the certificate, key and CA bundle configured on the cluster. It
+// returns (nil, nil) when route TLS is not configured.
+func newRouteTLSConfig(cfg *config.ClusterConfig) (*tls.Config, error) {
+	if !cfg.RouteTLSEnabled() {
+		return nil, nil
+	}
+
+	if cfg.Key() == nil {
+		return nil, errHalfEncrypted
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.RouteTLSCertFile, cfg.RouteTLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: cfg.RouteTLSSkipVerify,
+	}
+
+	if cfg.RouteTLSCaFile != "" {
+		pool, err := loadCertPool(cfg.RouteTLSCaFile)
+		if err != nil {
+			return nil, err
+		}
+
+		// A CA bundle enables mutual TLS: we verify the peer's certificate against
+		// it both when dialing and when accepting a connection on the route port.
+		tlsConfig.RootCAs = pool
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// loadCertPool reads a PEM-encoded CA bundle from disk into a *x509.CertPool.
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("service: unable to parse CA bundle " + caFile)
+	}
+
+	return pool, nil
+}
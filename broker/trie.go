@@ -0,0 +1,223 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"sync"
+)
+
+// Ssid is a parsed topic key, used to match published messages against subscribers.
+type Ssid []uint32
+
+// Subscription is a single (topic, ssid) pair subscribed to by a locally-connected
+// client, as tracked by SubscriptionTrie for ownership routing and rebalancing.
+type Subscription struct {
+	Topic string
+	Ssid  Ssid
+}
+
+// SubscriptionEvent is the wire representation of a subscribe/unsubscribe delta,
+// identifying the node the subscribing client is connected to.
+type SubscriptionEvent struct {
+	Node  string
+	Topic string
+	Ssid  Ssid
+}
+
+// MessageHandler is invoked for every locally-connected subscriber whose topic
+// matches a published or forwarded message. Connection handling registers one via
+// SubscriptionTrie.OnMessage to actually deliver to its clients.
+type MessageHandler func(ssid Ssid, topic string, payload []byte)
+
+// ssidKey returns a stable map key for an Ssid.
+func ssidKey(ssid Ssid) string {
+	buf := make([]byte, 4*len(ssid))
+	for i, part := range ssid {
+		binary.BigEndian.PutUint32(buf[i*4:], part)
+	}
+	return string(buf)
+}
+
+// SubscriptionTrie indexes subscriptions for this node, in two roles: the set of
+// subscriptions made by locally-connected clients (which need to be routed to
+// whichever node owns each topic), and, for the topics this node owns, the
+// authoritative set of remote nodes subscribed to them.
+type SubscriptionTrie struct {
+	mu      sync.RWMutex
+	local   map[string]Subscription    // ssid key -> subscription, for locally-connected clients.
+	owned   map[string]map[string]Ssid // topic -> node -> ssid, for topics this node owns.
+	handler MessageHandler
+}
+
+// NewSubscriptionTrie creates an empty subscription trie.
+func NewSubscriptionTrie() *SubscriptionTrie {
+	return &SubscriptionTrie{
+		local: make(map[string]Subscription),
+		owned: make(map[string]map[string]Ssid),
+	}
+}
+
+// OnMessage registers the handler invoked for every local subscriber matching a
+// published or forwarded message. Connection handling calls this once at startup
+// to wire delivery to connected clients.
+func (t *SubscriptionTrie) OnMessage(handler MessageHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handler = handler
+}
+
+// SubscribeLocal records a subscription made by a locally-connected client. Call
+// this (followed by routing the delta to the topic's owner) whenever a client on
+// this node subscribes.
+func (t *SubscriptionTrie) SubscribeLocal(topic string, ssid Ssid) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.local[ssidKey(ssid)] = Subscription{Topic: topic, Ssid: ssid}
+}
+
+// UnsubscribeLocal forgets a subscription previously recorded via SubscribeLocal.
+func (t *SubscriptionTrie) UnsubscribeLocal(topic string, ssid Ssid) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.local, ssidKey(ssid))
+}
+
+// Local returns every subscription made by a locally-connected client, so they can
+// be (re-)routed to their topic's current owner.
+func (t *SubscriptionTrie) Local() []Subscription {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	subs := make([]Subscription, 0, len(t.local))
+	for _, sub := range t.local {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// Subscribe registers node as a subscriber of topic/ssid, for a topic this node
+// owns. It is the terminal step of delta delivery, reached either because this
+// node is the topic's owner or because the delta arrived over the peer mesh.
+func (t *SubscriptionTrie) Subscribe(node, topic string, ssid Ssid) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	subs, ok := t.owned[topic]
+	if !ok {
+		subs = make(map[string]Ssid)
+		t.owned[topic] = subs
+	}
+	subs[node] = ssid
+}
+
+// Unsubscribe forgets a subscriber recorded via Subscribe.
+func (t *SubscriptionTrie) Unsubscribe(node, topic string, ssid Ssid) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if subs, ok := t.owned[topic]; ok {
+		delete(subs, node)
+		if len(subs) == 0 {
+			delete(t.owned, topic)
+		}
+	}
+}
+
+// RemoveNode forgets every subscriber entry owned on behalf of node, called once
+// that node has left the cluster.
+func (t *SubscriptionTrie) RemoveNode(node string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for topic, subs := range t.owned {
+		delete(subs, node)
+		if len(subs) == 0 {
+			delete(t.owned, topic)
+		}
+	}
+}
+
+// OwnedSubscribers returns the nodes currently subscribed to topic, for a topic
+// this node owns, so a published message can be fanned out to exactly them.
+func (t *SubscriptionTrie) OwnedSubscribers(topic string) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	subs, ok := t.owned[topic]
+	if !ok {
+		return nil
+	}
+
+	nodes := make([]string, 0, len(subs))
+	for node := range subs {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// DigestFor returns a hash of the subscriber entries this node holds, as owner,
+// on behalf of node. Anti-entropy keepalives compare this against the other
+// side's own view of what it expects to have asked this node to hold, which (
+// unlike two nodes' full, disjoint owned partitions) are actually comparable.
+func (t *SubscriptionTrie) DigestFor(node string) []byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var topics []string
+	for topic, subs := range t.owned {
+		if _, ok := subs[node]; ok {
+			topics = append(topics, topic)
+		}
+	}
+	return topicDigest(topics)
+}
+
+// topicDigest returns a stable hash of a set of topics, used to build directly
+// comparable anti-entropy digests.
+func topicDigest(topics []string) []byte {
+	sorted := append([]string(nil), topics...)
+	sort.Strings(sorted)
+
+	h := sha256.New()
+	for _, topic := range sorted {
+		h.Write([]byte(topic))
+	}
+	return h.Sum(nil)
+}
+
+// Publish delivers payload to every locally-connected subscriber of topic via the
+// registered MessageHandler. It is the terminal step for both a local publish and
+// a message forwarded here by a topic's owner.
+func (t *SubscriptionTrie) Publish(topic []byte, payload []byte) {
+	t.mu.RLock()
+	handler := t.handler
+	var matches []Subscription
+	for _, sub := range t.local {
+		if sub.Topic == string(topic) {
+			matches = append(matches, sub)
+		}
+	}
+	t.mu.RUnlock()
+
+	if handler == nil {
+		return
+	}
+	for _, sub := range matches {
+		handler(sub.Ssid, sub.Topic, payload)
+	}
+}
@@ -0,0 +1,120 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSubscriptionTrieLocal(t *testing.T) {
+	trie := NewSubscriptionTrie()
+	trie.SubscribeLocal("a/b", Ssid{1, 2})
+	trie.SubscribeLocal("c/d", Ssid{3, 4})
+
+	subs := trie.Local()
+	if len(subs) != 2 {
+		t.Fatalf("expected 2 local subscriptions, got %d", len(subs))
+	}
+
+	trie.UnsubscribeLocal("a/b", Ssid{1, 2})
+	subs = trie.Local()
+	if len(subs) != 1 || subs[0].Topic != "c/d" {
+		t.Fatalf("expected only c/d to remain, got %+v", subs)
+	}
+}
+
+func TestSubscriptionTrieOwnedSubscribers(t *testing.T) {
+	trie := NewSubscriptionTrie()
+	trie.Subscribe("node-1", "a/b", Ssid{1})
+	trie.Subscribe("node-2", "a/b", Ssid{2})
+	trie.Subscribe("node-1", "c/d", Ssid{3})
+
+	nodes := trie.OwnedSubscribers("a/b")
+	if len(nodes) != 2 {
+		t.Fatalf("expected 2 subscribers of a/b, got %d: %v", len(nodes), nodes)
+	}
+
+	trie.Unsubscribe("node-2", "a/b", Ssid{2})
+	nodes = trie.OwnedSubscribers("a/b")
+	if len(nodes) != 1 || nodes[0] != "node-1" {
+		t.Fatalf("expected only node-1 to remain subscribed to a/b, got %v", nodes)
+	}
+}
+
+func TestSubscriptionTrieRemoveNode(t *testing.T) {
+	trie := NewSubscriptionTrie()
+	trie.Subscribe("node-1", "a/b", Ssid{1})
+	trie.Subscribe("node-1", "c/d", Ssid{2})
+	trie.Subscribe("node-2", "a/b", Ssid{3})
+
+	trie.RemoveNode("node-1")
+
+	if nodes := trie.OwnedSubscribers("a/b"); len(nodes) != 1 || nodes[0] != "node-2" {
+		t.Fatalf("expected node-2 to remain subscribed to a/b after node-1 removed, got %v", nodes)
+	}
+	if nodes := trie.OwnedSubscribers("c/d"); len(nodes) != 0 {
+		t.Fatalf("expected c/d to have no subscribers after node-1 removed, got %v", nodes)
+	}
+}
+
+// TestSubscriptionTrieDigestForIsScoped is a regression test for a bug where the
+// digest compared a node's own full owned partition against a peer's, which are
+// disjoint by construction and would essentially never match. DigestFor must
+// instead be scoped to what this node holds specifically on behalf of one peer,
+// so two nodes describing the same relationship compute equal digests.
+func TestSubscriptionTrieDigestForIsScoped(t *testing.T) {
+	owner := NewSubscriptionTrie()
+	owner.Subscribe("peer-1", "a/b", Ssid{1})
+	owner.Subscribe("peer-1", "c/d", Ssid{2})
+	owner.Subscribe("peer-2", "e/f", Ssid{3})
+
+	peer := NewSubscriptionTrie()
+	peer.SubscribeLocal("a/b", Ssid{1})
+	peer.SubscribeLocal("c/d", Ssid{2})
+
+	ownerDigest := owner.DigestFor("peer-1")
+
+	var peerTopics []string
+	for _, sub := range peer.Local() {
+		peerTopics = append(peerTopics, sub.Topic)
+	}
+	peerDigest := topicDigest(peerTopics)
+
+	if !bytes.Equal(ownerDigest, peerDigest) {
+		t.Fatalf("digest for a matching (owner, peer) relationship should be equal")
+	}
+
+	if bytes.Equal(owner.DigestFor("peer-1"), owner.DigestFor("peer-2")) {
+		t.Fatalf("digests for different peers holding different topics should differ")
+	}
+}
+
+func TestSubscriptionTriePublishDeliversToLocalMatches(t *testing.T) {
+	trie := NewSubscriptionTrie()
+	trie.SubscribeLocal("a/b", Ssid{1})
+	trie.SubscribeLocal("c/d", Ssid{2})
+
+	var delivered []Ssid
+	trie.OnMessage(func(ssid Ssid, topic string, payload []byte) {
+		delivered = append(delivered, ssid)
+	})
+
+	trie.Publish([]byte("a/b"), []byte("hello"))
+
+	if len(delivered) != 1 || delivered[0][0] != 1 {
+		t.Fatalf("expected exactly the a/b subscriber to be delivered to, got %v", delivered)
+	}
+}
@@ -0,0 +1,60 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package config
+
+import "encoding/base64"
+
+// Config represents the configuration for the emitter service.
+type Config struct {
+	License         string         // The license used to start the service.
+	TCPPort         string         // The address on which to listen for TCP/HTTP connections.
+	Cluster         *ClusterConfig // The configuration for the clustering, if any.
+	ConfigTrustRoot string         // The path to the PEM-encoded public key used to verify signed config updates.
+}
+
+// ClusterConfig represents the configuration for the clustering.
+type ClusterConfig struct {
+	NodeName      string   // The name of this node, must be unique in the cluster.
+	Gossip        int      // The port used for the gossip protocol.
+	Route         int      // The port used for the peer route protocol.
+	AdvertiseAddr string   // The address to advertise to other nodes, or "public".
+	Seed          []string // The list of seed addresses to join on startup.
+	SnapshotPath  string   // The path to the file used to snapshot the cluster state.
+	StatePath     string   // The path to the persisted cluster state file, used to rejoin after a restart.
+	KeyString     string   // The base64-encoded gossip encryption key.
+
+	RouteTLSCertFile   string // The certificate used to serve and dial the peer route port.
+	RouteTLSKeyFile    string // The private key matching RouteTLSCertFile.
+	RouteTLSCaFile     string // The CA bundle used to verify peer certificates for mutual TLS.
+	RouteTLSSkipVerify bool   // Whether to skip certificate verification on the route port, for testing only.
+}
+
+// RouteTLSEnabled returns whether the peer route port should be served and dialed over TLS.
+func (c *ClusterConfig) RouteTLSEnabled() bool {
+	return c.RouteTLSCertFile != "" && c.RouteTLSKeyFile != ""
+}
+
+// Key decodes and returns the gossip encryption key, or nil if none was configured.
+func (c *ClusterConfig) Key() []byte {
+	if c.KeyString == "" {
+		return nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(c.KeyString)
+	if err != nil {
+		return nil
+	}
+	return key
+}